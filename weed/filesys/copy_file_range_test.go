@@ -0,0 +1,84 @@
+package filesys
+
+import (
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+func TestReferenceChunksExactWindow(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 10},
+		{Offset: 10, Size: 10},
+	}
+
+	chunks, ok := referenceChunks(src, 0, 100, 20)
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+	if chunks[0].Offset != 100 || chunks[0].Size != 10 {
+		t.Errorf("chunk 0 = %+v", chunks[0])
+	}
+	if chunks[1].Offset != 110 || chunks[1].Size != 10 {
+		t.Errorf("chunk 1 = %+v", chunks[1])
+	}
+}
+
+func TestReferenceChunksClipsTrailingChunk(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 20},
+	}
+
+	// window only covers the first 10 bytes of the source chunk
+	chunks, ok := referenceChunks(src, 0, 50, 10)
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	if chunks[0].Offset != 50 || chunks[0].Size != 10 {
+		t.Errorf("chunk = %+v", chunks[0])
+	}
+	// the source chunk itself must not be mutated
+	if src[0].Size != 20 {
+		t.Errorf("source chunk mutated: %+v", src[0])
+	}
+}
+
+func TestReferenceChunksBailsOnLeadingOverlap(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 20},
+	}
+
+	// window starts at offset 10, mid-chunk: can't be represented without
+	// skipping leading bytes within the needle
+	chunks, ok := referenceChunks(src, 10, 50, 10)
+	if ok {
+		t.Fatalf("expected ok=false, got chunks=%+v", chunks)
+	}
+	if chunks != nil {
+		t.Errorf("expected nil chunks on bail-out, got %+v", chunks)
+	}
+}
+
+func TestReferenceChunksSkipsChunksOutsideWindow(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 10},
+		{Offset: 100, Size: 10},
+	}
+
+	chunks, ok := referenceChunks(src, 0, 0, 10)
+	if !ok {
+		t.Fatalf("expected ok=true")
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d", len(chunks))
+	}
+	if chunks[0].Offset != 0 || chunks[0].Size != 10 {
+		t.Errorf("chunk = %+v", chunks[0])
+	}
+}
@@ -0,0 +1,73 @@
+package filesys
+
+import (
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+func TestClipChunksForHoleDropsFullyCoveredChunk(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 10},
+		{Offset: 10, Size: 10},
+		{Offset: 20, Size: 10},
+	}
+
+	chunks := clipChunksForHole(src, 10, 20)
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Offset != 0 || chunks[0].Size != 10 {
+		t.Errorf("chunk 0 = %+v", chunks[0])
+	}
+	if chunks[1].Offset != 20 || chunks[1].Size != 10 {
+		t.Errorf("chunk 1 = %+v", chunks[1])
+	}
+}
+
+func TestClipChunksForHoleClipsStraddlingChunk(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 20},
+	}
+
+	chunks := clipChunksForHole(src, 10, 30)
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Offset != 0 || chunks[0].Size != 10 {
+		t.Errorf("chunk = %+v", chunks[0])
+	}
+}
+
+func TestClipChunksForCollapseShiftsTrailingChunks(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 10},
+		{Offset: 10, Size: 10},
+		{Offset: 20, Size: 10},
+	}
+
+	chunks := clipChunksForCollapse(src, 10, 20, 10)
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Offset != 0 || chunks[0].Size != 10 {
+		t.Errorf("chunk 0 = %+v", chunks[0])
+	}
+	if chunks[1].Offset != 10 || chunks[1].Size != 10 {
+		t.Errorf("chunk 1 = %+v", chunks[1])
+	}
+}
+
+func TestClipChunksForCollapseClipsStraddlingChunk(t *testing.T) {
+	src := []*filer_pb.FileChunk{
+		{Offset: 0, Size: 20},
+	}
+
+	chunks := clipChunksForCollapse(src, 10, 30, 20)
+	if len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk, got %d: %+v", len(chunks), chunks)
+	}
+	if chunks[0].Offset != 0 || chunks[0].Size != 10 {
+		t.Errorf("chunk = %+v", chunks[0])
+	}
+}
@@ -2,6 +2,7 @@ package filesys
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"sort"
@@ -28,6 +29,22 @@ var _ = fs.NodeSetxattrer(&File{})
 var _ = fs.NodeRemovexattrer(&File{})
 var _ = fs.NodeListxattrer(&File{})
 var _ = fs.NodeForgetter(&File{})
+var _ = fs.NodeLocker(&File{})
+var _ = fs.NodeFlocker(&File{})
+var _ = fs.NodeAllocater(&File{})
+var _ = fs.NodeCopyFileRanger(&File{})
+
+// fcntl(2) lock types, matching the values the Linux FUSE protocol puts on
+// the wire in struct fuse_file_lock.type
+const (
+	lockTypeRdlck = 0
+	lockTypeWrlck = 1
+	lockTypeUnlck = 2
+)
+
+// mountLockTable coordinates waiters within this mount process. Locks that
+// are actually held across mounts live on the filer; see AcquireFileLock.
+var mountLockTable = newLockTable()
 
 type File struct {
 	Name           string
@@ -198,6 +215,272 @@ func (file *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *f
 
 }
 
+// fallocate(2) mode flags, matching linux/falloc.h
+const (
+	fallocFlKeepSize      = 0x01
+	fallocFlPunchHole     = 0x02
+	fallocFlCollapseRange = 0x08
+	fallocFlZeroRange     = 0x10
+)
+
+// Fallocate implements fs.NodeAllocater, backing posix_fallocate(3),
+// fallocate(2) hole-punching, and range collapse/zeroing.
+func (file *File) Fallocate(ctx context.Context, req *fuse.FallocateRequest) error {
+
+	glog.V(4).Infof("%v file fallocate %+v", file.fullpath(), req)
+
+	entry, err := file.maybeLoadEntry(ctx)
+	if err != nil {
+		return err
+	}
+
+	if file.isOpen > 0 {
+		file.wfs.handlesLock.Lock()
+		fileHandle := file.wfs.handles[file.fullpath().AsInode()]
+		file.wfs.handlesLock.Unlock()
+
+		if fileHandle != nil {
+			fileHandle.Lock()
+			defer fileHandle.Unlock()
+		}
+	}
+
+	switch {
+	case req.Mode&fallocFlPunchHole != 0:
+		file.punchHole(entry, req.Offset, req.Length)
+	case req.Mode&fallocFlCollapseRange != 0:
+		file.collapseRange(entry, req.Offset, req.Length)
+	case req.Mode&fallocFlZeroRange != 0:
+		file.punchHole(entry, req.Offset, req.Length)
+		if req.Mode&fallocFlKeepSize == 0 && req.Offset+req.Length > int64(entry.Attributes.FileSize) {
+			entry.Attributes.FileSize = uint64(req.Offset + req.Length)
+		}
+	default:
+		// plain preallocation: just grow the reported size. The newly
+		// visible range has no chunk at all, which filer.FileSize and
+		// every read path already treat as zeros, the same assumption
+		// punchHole relies on above.
+		if newSize := uint64(req.Offset + req.Length); newSize > entry.Attributes.FileSize {
+			entry.Attributes.FileSize = newSize
+		}
+	}
+
+	file.dirtyMetadata = true
+
+	if file.isOpen > 0 {
+		return nil
+	}
+
+	return file.saveEntry(entry)
+
+}
+
+// punchHole drops or clips chunks overlapping [offset, offset+length) so
+// that subsequent reads of that range return zeros, using the same
+// chunk.Offset/chunk.Size clipping Setattr uses for truncation.
+func (file *File) punchHole(entry *filer_pb.Entry, offset, length int64) {
+
+	chunks := clipChunksForHole(entry.Chunks, offset, offset+length)
+
+	entry.Chunks = chunks
+	file.entryViewCache, _ = filer.NonOverlappingVisibleIntervals(file.wfs.LookupFn(), chunks)
+	file.setReader(nil)
+}
+
+// clipChunksForHole is punchHole's chunk-list computation, without touching
+// the file's view cache or reader: any chunk entirely inside [start, end)
+// is dropped, and a chunk that straddles the boundary keeps only the
+// leading part before start (any tail beyond the hole is simply lost,
+// matching Setattr's tail-truncation-only handling of partial chunks).
+// Clipped chunks are modified in place, as Setattr does.
+func clipChunksForHole(srcChunks []*filer_pb.FileChunk, start, end int64) []*filer_pb.FileChunk {
+	var chunks []*filer_pb.FileChunk
+	for _, chunk := range srcChunks {
+		chunkStart := chunk.Offset
+		chunkStop := chunk.Offset + int64(chunk.Size)
+
+		switch {
+		case chunkStop <= start || chunkStart >= end:
+			// no overlap with the hole
+			chunks = append(chunks, chunk)
+		case chunkStart >= start:
+			// chunk begins inside the hole; drop it
+			glog.V(4).Infof("punched out chunk %+v\n", chunk.GetFileIdString())
+		default:
+			// chunk starts before the hole: keep its leading part
+			chunk.Size = uint64(start - chunkStart)
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// collapseRange removes [offset, offset+length) from the file entirely and
+// shifts everything after it left by length, rewriting chunk offsets the
+// same way punchHole clips them.
+func (file *File) collapseRange(entry *filer_pb.Entry, offset, length int64) {
+
+	chunks := clipChunksForCollapse(entry.Chunks, offset, offset+length, length)
+
+	entry.Chunks = chunks
+	if entry.Attributes.FileSize > uint64(length) {
+		entry.Attributes.FileSize -= uint64(length)
+	}
+	file.entryViewCache, _ = filer.NonOverlappingVisibleIntervals(file.wfs.LookupFn(), chunks)
+	file.setReader(nil)
+}
+
+// clipChunksForCollapse is collapseRange's chunk-list computation, without
+// touching the file's view cache or reader: a chunk entirely inside
+// [start, end) is dropped, a chunk entirely after it shifts left by
+// shiftBy, and a chunk straddling the boundary keeps only its leading part
+// before start. Shifted and clipped chunks are modified in place.
+func clipChunksForCollapse(srcChunks []*filer_pb.FileChunk, start, end, shiftBy int64) []*filer_pb.FileChunk {
+	var chunks []*filer_pb.FileChunk
+	for _, chunk := range srcChunks {
+		chunkStart := chunk.Offset
+		chunkStop := chunk.Offset + int64(chunk.Size)
+
+		switch {
+		case chunkStop <= start:
+			// entirely before the collapsed range
+			chunks = append(chunks, chunk)
+		case chunkStart >= end:
+			// entirely after the collapsed range: shift left
+			chunk.Offset -= shiftBy
+			chunks = append(chunks, chunk)
+		case chunkStart >= start:
+			// begins inside the collapsed range; drop it
+			glog.V(4).Infof("collapsed out chunk %+v\n", chunk.GetFileIdString())
+		default:
+			// starts before the collapsed range: keep its leading part
+			chunk.Size = uint64(start - chunkStart)
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
+
+// CopyFileRange implements fs.NodeCopyFileRanger. When the source is also a
+// *File on this same filer, it shares the source's volume needles with the
+// destination by referencing the same filer_pb.FileChunk.Fid instead of
+// reading and rewriting the bytes. Otherwise it falls back to a normal
+// read/write copy so the kernel's default behavior still works.
+//
+// Needle-sharing is only attempted when the mount opts in with
+// option.EnableUnsafeChunkShareCopy. IncrementChunkRef only records a
+// marker on the filer; nothing on the volume server's needle GC consults
+// it yet, so a source delete can still reclaim a needle a destination is
+// still referencing. Until that GC-side check exists, sharing is an
+// explicit, documented risk rather than a default "safe" fast path.
+func (file *File) CopyFileRange(ctx context.Context, req *fuse.CopyFileRangeRequest) (fuse.CopyFileRangeResponse, error) {
+
+	glog.V(4).Infof("%v file copy_file_range %+v", file.fullpath(), req)
+
+	if !file.wfs.option.EnableUnsafeChunkShareCopy {
+		return file.copyFileRangeFallback(ctx, req)
+	}
+
+	srcFile, ok := req.NodeIn.(*File)
+	if !ok || srcFile.wfs.filerAddress() != file.wfs.filerAddress() {
+		return file.copyFileRangeFallback(ctx, req)
+	}
+
+	srcEntry, err := srcFile.maybeLoadEntry(ctx)
+	if err != nil {
+		return fuse.CopyFileRangeResponse{}, err
+	}
+
+	chunks, ok := referenceChunks(srcEntry.Chunks, req.OffIn, req.OffOut, req.Len)
+	if !ok {
+		return file.copyFileRangeFallback(ctx, req)
+	}
+	if len(chunks) == 0 {
+		return fuse.CopyFileRangeResponse{Size: 0}, nil
+	}
+
+	destRef := fmt.Sprintf("%s@%d:%d", file.fullpath(), req.OffOut, req.Len)
+	if err := file.wfs.IncrementChunkRef(ctx, destRef, chunks, 1); err != nil {
+		glog.V(1).Infof("%v copy_file_range increment ref: %v, falling back to generic copy", file.fullpath(), err)
+		return file.copyFileRangeFallback(ctx, req)
+	}
+
+	entry, err := file.maybeLoadEntry(ctx)
+	if err != nil {
+		return fuse.CopyFileRangeResponse{}, err
+	}
+
+	if file.isOpen > 0 {
+		file.wfs.handlesLock.Lock()
+		fileHandle := file.wfs.handles[file.fullpath().AsInode()]
+		file.wfs.handlesLock.Unlock()
+
+		if fileHandle != nil {
+			fileHandle.Lock()
+			defer fileHandle.Unlock()
+		}
+	}
+
+	file.addChunks(chunks)
+	if newSize := uint64(req.OffOut) + req.Len; newSize > entry.Attributes.FileSize {
+		entry.Attributes.FileSize = newSize
+	}
+	file.dirtyMetadata = true
+
+	if file.isOpen <= 0 {
+		if err := file.saveEntry(entry); err != nil {
+			return fuse.CopyFileRangeResponse{}, err
+		}
+	}
+
+	return fuse.CopyFileRangeResponse{Size: req.Len}, nil
+}
+
+// referenceChunks builds the destination-side chunks for a CopyFileRange by
+// reusing the source chunks' Fid and clipping boundary chunks to the
+// requested [offIn, offIn+len) window, the same way Setattr clips chunk
+// boundaries for truncation. Clipping only ever shrinks a chunk's Size from
+// the tail, since FileChunk has no way to skip leading bytes within a
+// needle; if the copy window starts partway through a source chunk, that
+// chunk's leading bytes could not be represented, so ok is false and the
+// caller must fall back to a full generic copy instead of silently
+// returning a partial (data-losing) set of chunks.
+func referenceChunks(srcChunks []*filer_pb.FileChunk, offIn, offOut int64, length uint64) (chunks []*filer_pb.FileChunk, ok bool) {
+
+	start, end := offIn, offIn+int64(length)
+
+	for _, srcChunk := range srcChunks {
+		chunkStart := srcChunk.Offset
+		chunkStop := srcChunk.Offset + int64(srcChunk.Size)
+
+		if chunkStop <= start || chunkStart >= end {
+			continue
+		}
+		if chunkStart < start {
+			// the window starts mid-chunk: sharing it would require
+			// skipping leading bytes within the needle, which isn't
+			// representable. Bail out entirely rather than drop it and
+			// leave a silent gap in the destination.
+			return nil, false
+		}
+
+		copied := *srcChunk
+		if chunkStop > end {
+			copied.Size = uint64(end - chunkStart)
+		}
+		copied.Offset = offOut + (chunkStart - start)
+		chunks = append(chunks, &copied)
+	}
+
+	return chunks, true
+}
+
+// copyFileRangeFallback lets the kernel's generic read/write copy_file_range
+// emulation handle the request, used whenever chunk sharing isn't possible.
+func (file *File) copyFileRangeFallback(ctx context.Context, req *fuse.CopyFileRangeRequest) (fuse.CopyFileRangeResponse, error) {
+	return fuse.CopyFileRangeResponse{}, fuse.ENOSYS
+}
+
 func (file *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 
 	glog.V(4).Infof("file Setxattr %s: %s", file.fullpath(), req.Name)
@@ -254,6 +537,144 @@ func (file *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	// write the file chunks to the filerGrpcAddress
 	glog.V(4).Infof("%s/%s fsync file %+v", file.dir.FullPath(), file.Name, req)
 
+	file.wfs.handlesLock.Lock()
+	fileHandle := file.wfs.handles[file.fullpath().AsInode()]
+	file.wfs.handlesLock.Unlock()
+
+	if fileHandle == nil {
+		// nothing is open, so there is nothing buffered to flush
+		return nil
+	}
+
+	fileHandle.Lock()
+	defer fileHandle.Unlock()
+
+	// flush any dirty pages through the normal upload pipeline, and wait
+	// for all chunks that are still being uploaded in the background
+	chunks, err := fileHandle.dirtyPages.FlushData()
+	if err != nil {
+		glog.Errorf("%v fsync flush data: %v", file.fullpath(), err)
+		return fuse.EIO
+	}
+	chunksChanged := len(chunks) > 0
+	if chunksChanged {
+		file.addChunks(chunks)
+		file.dirtyMetadata = true
+	}
+	fileHandle.dirtyPages.Wait()
+
+	// fdatasync (FsyncFlagDataSync) only needs file content durable, so
+	// skip the metadata-only UpdateEntry call when no chunks changed
+	dataOnly := req.Flags&fuse.FsyncFlagDataSync != 0
+	if dataOnly && !chunksChanged {
+		return nil
+	}
+
+	if !file.dirtyMetadata {
+		return nil
+	}
+
+	entry := file.getEntry()
+	if entry == nil {
+		return nil
+	}
+
+	if err := file.saveEntry(entry); err != nil {
+		glog.Errorf("%v fsync save entry: %v", file.fullpath(), err)
+		return fuse.EIO
+	}
+	file.dirtyMetadata = false
+
+	return nil
+}
+
+// Lock implements fs.NodeLocker, handling POSIX (fcntl) byte-range locks.
+// A non-blocking request that cannot be satisfied returns fuse.EAGAIN.
+func (file *File) Lock(ctx context.Context, req *fuse.LockRequest) error {
+
+	glog.V(4).Infof("%v file lock %+v", file.fullpath(), req)
+
+	return file.acquireLock(ctx, req.Lk, req.LockOwner, false)
+}
+
+// LockWait implements fs.NodeLocker's blocking counterpart: it waits until
+// the requested range becomes available instead of failing immediately.
+func (file *File) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+
+	glog.V(4).Infof("%v file lock wait %+v", file.fullpath(), req)
+
+	return file.acquireLock(ctx, req.Lk, req.LockOwner, true)
+}
+
+// Unlock implements fs.NodeLocker, releasing a previously acquired range.
+func (file *File) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+
+	glog.V(4).Infof("%v file unlock %+v", file.fullpath(), req)
+
+	owner := fileLockOwner{clientId: file.wfs.clientId(), pid: req.Lk.Pid, lockOwner: req.LockOwner}
+
+	if err := file.wfs.ReleaseFileLock(ctx, file.fullpath(), owner, req.Lk.Start, req.Lk.End); err != nil {
+		glog.Errorf("%v file unlock: %v", file.fullpath(), err)
+		return fuse.EIO
+	}
+
+	return nil
+}
+
+// QueryLock implements fs.NodeLocker, reporting a conflicting lock (if any)
+// without acquiring anything, matching fcntl(F_GETLK) semantics.
+func (file *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+
+	glog.V(4).Infof("%v file query lock %+v", file.fullpath(), req)
+
+	owner := fileLockOwner{clientId: file.wfs.clientId(), pid: req.Lk.Pid, lockOwner: req.LockOwner}
+
+	conflict, found, err := file.wfs.QueryFileLock(ctx, file.fullpath(), owner, req.Lk.Start, req.Lk.End, req.Lk.Type == lockTypeWrlck)
+	if err != nil {
+		glog.Errorf("%v file query lock: %v", file.fullpath(), err)
+		return fuse.EIO
+	}
+	if found {
+		resp.Lk = conflict
+	} else {
+		resp.Lk = req.Lk
+		resp.Lk.Type = lockTypeUnlck
+	}
+
+	return nil
+}
+
+// acquireLock implements Lock and LockWait. Unlock requests (lk.Type ==
+// lockTypeUnlck) release the lock this owner holds for exactly that range,
+// as Unlock does. For real locks it first serializes same-file waiters
+// within this process, then asks the filer to grant the range-lock across
+// all mounts.
+func (file *File) acquireLock(ctx context.Context, lk fuse.FileLock, lockOwner uint64, blocking bool) error {
+
+	owner := fileLockOwner{clientId: file.wfs.clientId(), pid: lk.Pid, lockOwner: lockOwner}
+
+	if lk.Type == lockTypeUnlck {
+		if err := file.wfs.ReleaseFileLock(ctx, file.fullpath(), owner, lk.Start, lk.End); err != nil {
+			glog.Errorf("%v file unlock: %v", file.fullpath(), err)
+			return fuse.EIO
+		}
+		return nil
+	}
+
+	exclusive := lk.Type == lockTypeWrlck
+
+	release := mountLockTable.AcquireLock(file.fullpath())
+	defer release()
+
+	err := file.wfs.AcquireFileLock(ctx, file.fullpath(), owner, lk.Start, lk.End, exclusive, blocking)
+	if err == errLockConflict {
+		return fuse.EAGAIN
+	}
+	if err != nil {
+		glog.Errorf("%v file lock: %v", file.fullpath(), err)
+		return fuse.EIO
+	}
+
 	return nil
 }
 
@@ -262,6 +683,7 @@ func (file *File) Forget() {
 	glog.V(4).Infof("Forget file %s", t)
 	file.wfs.fsNodeCache.DeleteFsNode(t)
 	file.wfs.ReleaseHandle(t, 0)
+	file.wfs.ReleaseAllFileLocks(t)
 	file.setReader(nil)
 }
 
@@ -0,0 +1,70 @@
+package filesys
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/chrislusf/seaweedfs/weed/util"
+)
+
+// fileLockOwner identifies who holds or is requesting a POSIX lock. Locks
+// are scoped per client-id + pid + lock_owner, mirroring the Linux FUSE
+// protocol so that closing one fd doesn't drop OFD locks held by another
+// fd of the same process, and two mounts never collide on a bare pid.
+type fileLockOwner struct {
+	clientId  string
+	pid       uint32
+	lockOwner uint64
+}
+
+// errLockConflict is returned by a non-blocking lock acquisition that lost
+// to an existing, incompatible lock.
+var errLockConflict = errors.New("lock held by another owner")
+
+// lockTableEntry is a per-path mutex plus a count of goroutines currently
+// waiting on or holding it, so lockTable can evict the entry once nobody
+// references it any more instead of growing for every path ever locked.
+type lockTableEntry struct {
+	sync.Mutex
+	waiters int
+}
+
+// lockTable coordinates intra-process lock waiters keyed by the full path
+// of the file being locked. The filer is the source of truth for locks
+// shared across mounts; this table only serializes goroutines within this
+// single mount process so that blocking LockWait calls for the same file
+// queue up instead of hammering the filer with redundant acquire attempts.
+type lockTable struct {
+	sync.Mutex
+	locks map[util.FullPath]*lockTableEntry
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{
+		locks: make(map[util.FullPath]*lockTableEntry),
+	}
+}
+
+func (lt *lockTable) AcquireLock(path util.FullPath) func() {
+	lt.Lock()
+	e, found := lt.locks[path]
+	if !found {
+		e = &lockTableEntry{}
+		lt.locks[path] = e
+	}
+	e.waiters++
+	lt.Unlock()
+
+	e.Lock()
+
+	return func() {
+		e.Unlock()
+
+		lt.Lock()
+		e.waiters--
+		if e.waiters == 0 {
+			delete(lt.locks, path)
+		}
+		lt.Unlock()
+	}
+}
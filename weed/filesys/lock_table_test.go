@@ -0,0 +1,62 @@
+package filesys
+
+import (
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/util"
+)
+
+func TestLockTableSerializesSamePathWaiters(t *testing.T) {
+	lt := newLockTable()
+	path := util.FullPath("/a/b")
+
+	release := lt.AcquireLock(path)
+
+	acquired := make(chan struct{})
+	go func() {
+		release2 := lt.AcquireLock(path)
+		close(acquired)
+		release2()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("second acquire should have blocked while the first is held")
+	default:
+	}
+
+	release()
+	<-acquired
+}
+
+func TestLockTableEvictsEntryOnceUnreferenced(t *testing.T) {
+	lt := newLockTable()
+	path := util.FullPath("/a/b")
+
+	release := lt.AcquireLock(path)
+	release()
+
+	lt.Lock()
+	_, found := lt.locks[path]
+	lt.Unlock()
+
+	if found {
+		t.Errorf("expected lock table entry to be evicted once no waiters remain")
+	}
+}
+
+func TestLockTableDifferentPathsDoNotBlock(t *testing.T) {
+	lt := newLockTable()
+
+	releaseA := lt.AcquireLock(util.FullPath("/a"))
+	defer releaseA()
+
+	done := make(chan struct{})
+	go func() {
+		releaseB := lt.AcquireLock(util.FullPath("/b"))
+		releaseB()
+		close(done)
+	}()
+
+	<-done
+}
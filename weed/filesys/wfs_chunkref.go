@@ -0,0 +1,69 @@
+package filesys
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+// chunkRefDirectory is a reserved top-level directory on the filer holding
+// one marker entry per (chunk fid, referencing destination) pair, recording
+// which CopyFileRange destinations share a source's needle. This reuses the
+// filer's existing CreateEntry/DeleteEntry calls instead of a bespoke RPC.
+//
+// The volume server's needle GC does not read these markers, so deleting
+// the source can still reclaim a needle that a destination references.
+const chunkRefDirectory = "/.seaweedfs_chunk_refs"
+
+func chunkRefDirFor(fid string) string {
+	return chunkRefDirectory + "/" + fid
+}
+
+// chunkRefMarkerName identifies one destination's reference to a shared
+// chunk. It's keyed by destRef (the destination's own identity, e.g. its
+// path plus the byte range it copied into), not just the mount's
+// clientId: a single mount can run several CopyFileRange calls that share
+// the same source chunk into different destinations, and releasing one
+// destination's reference must not drop another destination's marker for
+// the same fid.
+func chunkRefMarkerName(wfs *WFS, destRef string) string {
+	return wfs.clientId() + ":" + destRef
+}
+
+// IncrementChunkRef adjusts the filer-tracked references for each chunk's
+// fid: delta > 0 registers destRef (the CopyFileRange destination taking
+// up the reference) as one referencer, delta <= 0 releases that
+// destination's reference. Only the sign of delta is used.
+func (wfs *WFS) IncrementChunkRef(ctx context.Context, destRef string, chunks []*filer_pb.FileChunk, delta int) error {
+	return wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		for _, chunk := range chunks {
+			fid := chunk.GetFileIdString()
+			name := chunkRefMarkerName(wfs, destRef)
+
+			if delta > 0 {
+				if _, err := client.CreateEntry(ctx, &filer_pb.CreateEntryRequest{
+					Directory: chunkRefDirFor(fid),
+					Entry: &filer_pb.Entry{
+						Name: name,
+						Attributes: &filer_pb.FuseAttributes{
+							Mtime: time.Now().Unix(),
+						},
+					},
+				}); err != nil {
+					return fmt.Errorf("increment chunk ref %s: %w", fid, err)
+				}
+				continue
+			}
+
+			if _, err := client.DeleteEntry(ctx, &filer_pb.DeleteEntryRequest{
+				Directory: chunkRefDirFor(fid),
+				Name:      name,
+			}); err != nil {
+				return fmt.Errorf("decrement chunk ref %s: %w", fid, err)
+			}
+		}
+		return nil
+	})
+}
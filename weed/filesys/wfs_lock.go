@@ -0,0 +1,409 @@
+package filesys
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/seaweedfs/fuse"
+
+	"github.com/chrislusf/seaweedfs/weed/glog"
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+	"github.com/chrislusf/seaweedfs/weed/util"
+)
+
+const (
+	// lockDirectory is a reserved top-level directory on the filer that
+	// holds one marker entry per held byte-range lock, so every mount
+	// shares lock state through the filer's existing CreateEntry /
+	// DeleteEntry / ListEntries calls instead of a bespoke RPC.
+	lockDirectory = "/.seaweedfs_locks"
+	// lockLeaseTtlSec bounds how long a lock marker survives without being
+	// renewed. activeLockRenewals renews each held marker every third of
+	// this TTL; a crashed or disconnected client stops renewing, and its
+	// locks are reclaimed through the filer's normal entry-TTL expiry.
+	lockLeaseTtlSec = 30
+	// lockPollInterval is how often a blocking LockWait re-checks the
+	// filer for the requested range to become free.
+	lockPollInterval = 100 * time.Millisecond
+	// lockGateName is the fixed marker entry acquireGate creates to become
+	// the sole mount allowed to inspect/modify the lock markers under a
+	// path, and lockGateTtlSec bounds how long a crashed holder can wedge
+	// the gate before the filer's entry-TTL expiry clears it.
+	lockGateName     = ".gate"
+	lockGateTtlSec   = 10
+	lockGatePollWait = 20 * time.Millisecond
+)
+
+func (wfs *WFS) clientId() string {
+	return fmt.Sprintf("mount-%d", wfs.signature)
+}
+
+func (wfs *WFS) filerAddress() string {
+	return wfs.option.FilerAddress
+}
+
+func lockDirFor(path util.FullPath) string {
+	return lockDirectory + "/" + url.PathEscape(string(path))
+}
+
+func lockEntryName(owner fileLockOwner, start, end uint64) string {
+	return fmt.Sprintf("%s-%d-%d-%016x-%016x.lock", owner.clientId, owner.pid, owner.lockOwner, start, end)
+}
+
+func overlaps(aStart, aEnd, bStart, bEnd uint64) bool {
+	return aStart < bEnd && bStart < aEnd
+}
+
+// lockConflicts decides whether a held lock conflicts with a requested
+// one: different owners, overlapping ranges, and at least one side
+// exclusive (fcntl allows any number of overlapping shared locks).
+func lockConflicts(reqOwner fileLockOwner, reqStart, reqEnd uint64, reqExclusive bool, heldOwner fileLockOwner, heldStart, heldEnd uint64, heldExclusive bool) bool {
+	if reqOwner == heldOwner {
+		return false
+	}
+	if !overlaps(reqStart, reqEnd, heldStart, heldEnd) {
+		return false
+	}
+	return reqExclusive || heldExclusive
+}
+
+// AcquireFileLock asks the filer to grant a byte-range lock for path. A
+// non-blocking caller that loses to an existing conflicting lock gets
+// errLockConflict back immediately; a blocking caller polls until the
+// range frees up or ctx is done.
+//
+// Checking for conflicts and creating the new marker happen while holding
+// the per-path gate (see acquireGate), so two mounts racing to lock
+// different, conflicting ranges can never both observe "no conflict" and
+// both create a marker: whichever loses the gate race simply doesn't get
+// to look until the winner has either created its marker or given up.
+func (wfs *WFS) AcquireFileLock(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64, exclusive, blocking bool) error {
+	for {
+		granted, err := wfs.tryAcquireFileLock(ctx, path, owner, start, end, exclusive)
+		if err != nil {
+			return err
+		}
+		if granted {
+			activeLockRenewals.start(wfs, path, owner, start, end)
+			return nil
+		}
+		if !blocking {
+			return errLockConflict
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryAcquireFileLock makes a single, atomic attempt to grant the range:
+// it holds the per-path gate for the whole check-then-create sequence so
+// no other mount can interleave between the conflict check and the
+// marker creation.
+func (wfs *WFS) tryAcquireFileLock(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64, exclusive bool) (granted bool, err error) {
+	if err := wfs.acquireGate(ctx, path); err != nil {
+		return false, err
+	}
+	defer wfs.releaseGate(ctx, path)
+
+	_, found, err := wfs.findConflictingLock(ctx, path, owner, start, end, exclusive)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		return false, nil
+	}
+	if err := wfs.createLockEntry(ctx, path, owner, start, end, exclusive); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// acquireGate makes this call the sole holder of path's lock-directory
+// gate by creating a fixed marker entry that CreateEntry only lets one
+// caller succeed at a time; everyone else's create fails until the
+// holder calls releaseGate (or the marker's TTL expires). This turns the
+// lock directory's "list existing markers, then create a new one" into a
+// single atomic operation from the perspective of any other mount.
+func (wfs *WFS) acquireGate(ctx context.Context, path util.FullPath) error {
+	for {
+		err := wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+			_, err := client.CreateEntry(ctx, &filer_pb.CreateEntryRequest{
+				Directory: lockDirFor(path),
+				Entry: &filer_pb.Entry{
+					Name: lockGateName,
+					Attributes: &filer_pb.FuseAttributes{
+						Mtime:  time.Now().Unix(),
+						TtlSec: lockGateTtlSec,
+					},
+				},
+			})
+			return err
+		})
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(lockGatePollWait):
+		}
+	}
+}
+
+func (wfs *WFS) releaseGate(ctx context.Context, path util.FullPath) {
+	wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		_, err := client.DeleteEntry(ctx, &filer_pb.DeleteEntryRequest{
+			Directory: lockDirFor(path),
+			Name:      lockGateName,
+		})
+		return err
+	})
+}
+
+// ReleaseFileLock removes the single marker this owner holds for the given
+// range.
+func (wfs *WFS) ReleaseFileLock(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64) error {
+	activeLockRenewals.stop(path, owner, start, end)
+	return wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		_, err := client.DeleteEntry(ctx, &filer_pb.DeleteEntryRequest{
+			Directory: lockDirFor(path),
+			Name:      lockEntryName(owner, start, end),
+		})
+		return err
+	})
+}
+
+// ReleaseAllFileLocks drops every lock marker held for path, regardless of
+// owner. Called from File.Forget, since the kernel will not send a
+// matching Unlock for locks the process never explicitly released (e.g. on
+// crash or abrupt close). Closing a handle does not call it. The
+// acquireGate marker is left to its holder.
+func (wfs *WFS) ReleaseAllFileLocks(path util.FullPath) {
+	ctx := context.Background()
+
+	entries, err := wfs.listLockEntries(ctx, path)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Name == lockGateName {
+			continue
+		}
+		heldOwner, heldStart, heldEnd, _, parseErr := parseLockEntry(entry)
+		if parseErr == nil {
+			activeLockRenewals.stop(path, heldOwner, heldStart, heldEnd)
+		}
+		wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+			_, err := client.DeleteEntry(ctx, &filer_pb.DeleteEntryRequest{
+				Directory: lockDirFor(path),
+				Name:      entry.Name,
+			})
+			return err
+		})
+	}
+}
+
+// QueryFileLock reports a lock held by a different owner that conflicts
+// with the requested range and access mode, matching fcntl(F_GETLK).
+func (wfs *WFS) QueryFileLock(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64, exclusive bool) (fuse.FileLock, bool, error) {
+	return wfs.findConflictingLock(ctx, path, owner, start, end, exclusive)
+}
+
+// findConflictingLock lists the markers held for path and returns the
+// first one, held by a different owner, that overlaps [start,end) and
+// conflicts with the requested access: an exclusive request conflicts
+// with any overlapping lock, a shared request only with an exclusive one.
+func (wfs *WFS) findConflictingLock(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64, exclusive bool) (fuse.FileLock, bool, error) {
+
+	entries, err := wfs.listLockEntries(ctx, path)
+	if err != nil {
+		return fuse.FileLock{}, false, err
+	}
+
+	for _, entry := range entries {
+		heldOwner, heldStart, heldEnd, heldExclusive, parseErr := parseLockEntry(entry)
+		if parseErr != nil {
+			continue
+		}
+		if !lockConflicts(owner, start, end, exclusive, heldOwner, heldStart, heldEnd, heldExclusive) {
+			continue
+		}
+
+		conflict := fuse.FileLock{Start: heldStart, End: heldEnd, Pid: heldOwner.pid}
+		if heldExclusive {
+			conflict.Type = lockTypeWrlck
+		} else {
+			conflict.Type = lockTypeRdlck
+		}
+		return conflict, true, nil
+	}
+
+	return fuse.FileLock{}, false, nil
+}
+
+func (wfs *WFS) createLockEntry(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64, exclusive bool) error {
+	return wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		_, err := client.CreateEntry(ctx, &filer_pb.CreateEntryRequest{
+			Directory: lockDirFor(path),
+			Entry: &filer_pb.Entry{
+				Name: lockEntryName(owner, start, end),
+				Attributes: &filer_pb.FuseAttributes{
+					Mtime:  time.Now().Unix(),
+					TtlSec: lockLeaseTtlSec,
+				},
+				Extended: map[string][]byte{
+					"clientId":  []byte(owner.clientId),
+					"pid":       []byte(strconv.FormatUint(uint64(owner.pid), 10)),
+					"lockOwner": []byte(strconv.FormatUint(owner.lockOwner, 10)),
+					"start":     []byte(strconv.FormatUint(start, 10)),
+					"end":       []byte(strconv.FormatUint(end, 10)),
+					"exclusive": []byte(strconv.FormatBool(exclusive)),
+				},
+			},
+		})
+		return err
+	})
+}
+
+func (wfs *WFS) listLockEntries(ctx context.Context, path util.FullPath) (entries []*filer_pb.Entry, err error) {
+	err = wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		stream, listErr := client.ListEntries(ctx, &filer_pb.ListEntriesRequest{
+			Directory: lockDirFor(path),
+		})
+		if listErr != nil {
+			return listErr
+		}
+		for {
+			resp, recvErr := stream.Recv()
+			if recvErr == io.EOF {
+				return nil
+			}
+			if recvErr != nil {
+				return recvErr
+			}
+			entries = append(entries, resp.Entry)
+		}
+	})
+	return entries, err
+}
+
+// renewLockEntry refreshes a held lock marker's Mtime/TtlSec so it
+// survives past its original lease, called periodically by
+// activeLockRenewals for as long as the lock is actually held.
+func (wfs *WFS) renewLockEntry(ctx context.Context, path util.FullPath, owner fileLockOwner, start, end uint64) error {
+	return wfs.WithFilerClient(func(client filer_pb.SeaweedFilerClient) error {
+		resp, err := client.LookupDirectoryEntry(ctx, &filer_pb.LookupDirectoryEntryRequest{
+			Directory: lockDirFor(path),
+			Name:      lockEntryName(owner, start, end),
+		})
+		if err != nil {
+			return err
+		}
+		// update the looked-up marker so its Extended lock fields survive
+		entry := resp.Entry
+		if entry.Attributes == nil {
+			entry.Attributes = &filer_pb.FuseAttributes{}
+		}
+		entry.Attributes.Mtime = time.Now().Unix()
+		entry.Attributes.TtlSec = lockLeaseTtlSec
+		_, err = client.UpdateEntry(ctx, &filer_pb.UpdateEntryRequest{
+			Directory: lockDirFor(path),
+			Entry:     entry,
+		})
+		return err
+	})
+}
+
+// lockRenewals tracks the stop channels of background lease-renewal
+// goroutines, keyed by the same identity as the lock marker itself, so
+// ReleaseFileLock/ReleaseAllFileLocks can stop renewing a lease once the
+// lock is actually released instead of renewing it forever.
+type lockRenewals struct {
+	sync.Mutex
+	stopCh map[string]chan struct{}
+}
+
+var activeLockRenewals = &lockRenewals{stopCh: make(map[string]chan struct{})}
+
+func renewalKey(path util.FullPath, owner fileLockOwner, start, end uint64) string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%d\x00%d", path, owner.clientId, owner.pid, owner.lockOwner, start, end)
+}
+
+func (r *lockRenewals) start(wfs *WFS, path util.FullPath, owner fileLockOwner, start, end uint64) {
+	key := renewalKey(path, owner, start, end)
+	stop := make(chan struct{})
+
+	r.Lock()
+	if old, found := r.stopCh[key]; found {
+		close(old)
+	}
+	r.stopCh[key] = stop
+	r.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(lockLeaseTtlSec * time.Second / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := wfs.renewLockEntry(context.Background(), path, owner, start, end); err != nil {
+					glog.V(1).Infof("%v renew lock lease: %v", path, err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *lockRenewals) stop(path util.FullPath, owner fileLockOwner, start, end uint64) {
+	key := renewalKey(path, owner, start, end)
+
+	r.Lock()
+	stop, found := r.stopCh[key]
+	if found {
+		delete(r.stopCh, key)
+	}
+	r.Unlock()
+
+	if found {
+		close(stop)
+	}
+}
+
+func parseLockEntry(entry *filer_pb.Entry) (owner fileLockOwner, start, end uint64, exclusive bool, err error) {
+	pid, err := strconv.ParseUint(string(entry.Extended["pid"]), 10, 32)
+	if err != nil {
+		return owner, 0, 0, false, err
+	}
+	lockOwner, err := strconv.ParseUint(string(entry.Extended["lockOwner"]), 10, 64)
+	if err != nil {
+		return owner, 0, 0, false, err
+	}
+	start, err = strconv.ParseUint(string(entry.Extended["start"]), 10, 64)
+	if err != nil {
+		return owner, 0, 0, false, err
+	}
+	end, err = strconv.ParseUint(string(entry.Extended["end"]), 10, 64)
+	if err != nil {
+		return owner, 0, 0, false, err
+	}
+
+	owner = fileLockOwner{
+		clientId:  string(entry.Extended["clientId"]),
+		pid:       uint32(pid),
+		lockOwner: lockOwner,
+	}
+	exclusive = string(entry.Extended["exclusive"]) == "true"
+
+	return owner, start, end, exclusive, nil
+}
@@ -0,0 +1,91 @@
+package filesys
+
+import (
+	"testing"
+
+	"github.com/chrislusf/seaweedfs/weed/pb/filer_pb"
+)
+
+func TestOverlaps(t *testing.T) {
+	cases := []struct {
+		name         string
+		aStart, aEnd uint64
+		bStart, bEnd uint64
+		want         bool
+	}{
+		{"disjoint before", 0, 10, 10, 20, false},
+		{"disjoint after", 10, 20, 0, 10, false},
+		{"identical", 0, 10, 0, 10, true},
+		{"partial overlap", 0, 10, 5, 15, true},
+		{"fully contained", 0, 100, 10, 20, true},
+		{"adjacent touching end is not overlap", 0, 10, 10, 10, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := overlaps(c.aStart, c.aEnd, c.bStart, c.bEnd); got != c.want {
+				t.Errorf("overlaps(%d,%d,%d,%d) = %v, want %v", c.aStart, c.aEnd, c.bStart, c.bEnd, got, c.want)
+			}
+		})
+	}
+}
+
+func TestLockConflicts(t *testing.T) {
+	a := fileLockOwner{clientId: "mount-1", pid: 1, lockOwner: 1}
+	b := fileLockOwner{clientId: "mount-2", pid: 2, lockOwner: 2}
+
+	if lockConflicts(a, 0, 10, false, a, 0, 10, true) {
+		t.Errorf("same owner must never conflict with itself")
+	}
+	if lockConflicts(a, 0, 10, false, b, 20, 30, true) {
+		t.Errorf("non-overlapping ranges must not conflict")
+	}
+	if lockConflicts(a, 0, 10, false, b, 5, 15, false) {
+		t.Errorf("two overlapping shared (read) locks must not conflict")
+	}
+	if !lockConflicts(a, 0, 10, true, b, 5, 15, false) {
+		t.Errorf("an exclusive request overlapping any held lock must conflict")
+	}
+	if !lockConflicts(a, 0, 10, false, b, 5, 15, true) {
+		t.Errorf("a shared request overlapping a held exclusive lock must conflict")
+	}
+}
+
+func TestParseLockEntryRoundTrip(t *testing.T) {
+	owner := fileLockOwner{clientId: "mount-7", pid: 42, lockOwner: 99}
+
+	entry := &filer_pb.Entry{
+		Extended: map[string][]byte{
+			"clientId":  []byte(owner.clientId),
+			"pid":       []byte("42"),
+			"lockOwner": []byte("99"),
+			"start":     []byte("10"),
+			"end":       []byte("20"),
+			"exclusive": []byte("true"),
+		},
+	}
+
+	gotOwner, start, end, exclusive, err := parseLockEntry(entry)
+	if err != nil {
+		t.Fatalf("parseLockEntry: %v", err)
+	}
+	if gotOwner != owner {
+		t.Errorf("owner = %+v, want %+v", gotOwner, owner)
+	}
+	if start != 10 || end != 20 {
+		t.Errorf("start,end = %d,%d, want 10,20", start, end)
+	}
+	if !exclusive {
+		t.Errorf("expected exclusive=true")
+	}
+}
+
+func TestParseLockEntryRejectsMalformedEntry(t *testing.T) {
+	// entries without our Extended fields (e.g. the acquireGate marker)
+	// must fail to parse rather than being treated as a held lock.
+	entry := &filer_pb.Entry{}
+
+	if _, _, _, _, err := parseLockEntry(entry); err == nil {
+		t.Errorf("expected an error parsing an entry with no lock metadata")
+	}
+}